@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// iceConfigPath is where the ICE server list is loaded from.
+var iceConfigPath = envOr("ICE_CONFIG_PATH", "ice_servers.json")
+
+// iceServerConfig mirrors webrtc.ICEServer so the same JSON can be loaded
+// server-side and handed to the browser's RTCPeerConnection as-is.
+type iceServerConfig struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+var (
+	iceConfigOnce sync.Once
+	iceConfigLock sync.RWMutex
+	iceServers    = []iceServerConfig{{URLs: []string{"stun:stun.l.google.com:19302"}}}
+)
+
+// loadICEConfig reads iceConfigPath once, and registers a SIGHUP handler to
+// reload it afterwards so ICE/TURN credentials can be rotated without a
+// restart.
+func loadICEConfig() {
+	iceConfigOnce.Do(func() {
+		reloadICEConfig()
+
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		go func() {
+			for range sighup {
+				log.Println("SIGHUP received, reloading ICE config from", iceConfigPath)
+				reloadICEConfig()
+			}
+		}()
+	})
+}
+
+// reloadICEConfig re-reads iceConfigPath, leaving the current server list in
+// place if the file is missing or malformed.
+func reloadICEConfig() {
+	data, err := os.ReadFile(iceConfigPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("ICE config:", err)
+		}
+		return
+	}
+
+	var servers []iceServerConfig
+	if err := json.Unmarshal(data, &servers); err != nil {
+		log.Println("ICE config: invalid JSON in", iceConfigPath, ":", err)
+		return
+	}
+
+	iceConfigLock.Lock()
+	iceServers = servers
+	iceConfigLock.Unlock()
+}
+
+// ICEServers returns the currently loaded ICE server list, loading it from
+// disk on first use.
+func ICEServers() []iceServerConfig {
+	loadICEConfig()
+
+	iceConfigLock.RLock()
+	defer iceConfigLock.RUnlock()
+	out := make([]iceServerConfig, len(iceServers))
+	copy(out, iceServers)
+	return out
+}
+
+// PeerConnectionConfig builds the webrtc.Configuration peer connections
+// should be created with, from the current ICE server list.
+func PeerConnectionConfig() webrtc.Configuration {
+	servers := ICEServers()
+	cfg := webrtc.Configuration{ICEServers: make([]webrtc.ICEServer, len(servers))}
+	for i, s := range servers {
+		cfg.ICEServers[i] = webrtc.ICEServer{
+			URLs:       s.URLs,
+			Username:   s.Username,
+			Credential: s.Credential,
+		}
+	}
+	return cfg
+}
+
+// handleICE serves the current ICE server list as JSON, for the browser
+// client to pass straight to its RTCPeerConnection constructor.
+func handleICE(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ICEServers()); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
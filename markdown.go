@@ -0,0 +1,27 @@
+package main
+
+import (
+	"html"
+	"regexp"
+)
+
+// Minimal safe-subset markdown: bold, italic, inline code and links. Inputs
+// are HTML-escaped first so rendered chat messages can never inject markup.
+var (
+	mdBold   = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	mdItalic = regexp.MustCompile(`\*([^*]+)\*`)
+	mdCode   = regexp.MustCompile("`([^`]+)`")
+	mdLink   = regexp.MustCompile(`\[([^\]]+)\]\((https?://[^\s)]+)\)`)
+)
+
+// renderMarkdown renders a chat message's markdown to sanitized HTML, in the
+// same spirit as harmony's markdownRenderer: a small fixed set of inline
+// rules rather than a full CommonMark implementation.
+func renderMarkdown(src string) string {
+	out := html.EscapeString(src)
+	out = mdLink.ReplaceAllString(out, `<a href="$2" target="_blank" rel="noopener noreferrer">$1</a>`)
+	out = mdBold.ReplaceAllString(out, "<strong>$1</strong>")
+	out = mdItalic.ReplaceAllString(out, "<em>$1</em>")
+	out = mdCode.ReplaceAllString(out, "<code>$1</code>")
+	return out
+}
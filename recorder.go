@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+	"github.com/pion/webrtc/v2/pkg/media/h264writer"
+	"github.com/pion/webrtc/v2/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v2/pkg/media/oggwriter"
+)
+
+// recordingsDir is where recordings are written, one subdirectory per room.
+var recordingsDir = envOr("RECORDINGS_DIR", "recordings")
+
+// defaultMaxRecordingFileSize is what a track's file is rotated at when
+// RECORDING_MAX_FILE_SIZE isn't set.
+const defaultMaxRecordingFileSize = 64 * 1024 * 1024 // 64MB
+
+// maxRecordingFileSize rotates a track's file once it has written roughly
+// this many bytes of payload, so a long-running recording doesn't produce
+// one unbounded file. Configurable via RECORDING_MAX_FILE_SIZE (bytes).
+var maxRecordingFileSize = recordingMaxFileSize()
+
+func recordingMaxFileSize() int64 {
+	v := os.Getenv("RECORDING_MAX_FILE_SIZE")
+	if v == "" {
+		return defaultMaxRecordingFileSize
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		log.Printf("RECORDING_MAX_FILE_SIZE: invalid value %q, using default", v)
+		return defaultMaxRecordingFileSize
+	}
+	return n
+}
+
+// trackWriter is implemented by the oggwriter, ivfwriter and h264writer
+// writers, the three container writers a Recorder uses.
+type trackWriter interface {
+	WriteRTP(*rtp.Packet) error
+	Close() error
+}
+
+// Recorder writes every track published in a single room to disk, one
+// container file per track: Opus audio as Ogg (oggwriter), VP8 video as IVF
+// (ivfwriter), H264 video as raw Annex B (h264writer) — pion v2 ships no
+// WebM muxer, so these are the closest containers it supports. VP9 has no
+// writer in this pion version at all, so a VP9 upTrack is logged and
+// skipped rather than recorded. A Recorder is created by Room.StartRecording
+// and lives until Room.StopRecording or the room empties.
+type Recorder struct {
+	roomID    string
+	dir       string
+	startUnix int64
+
+	mu     sync.Mutex
+	tracks map[*upTrack]*recordedTrack
+}
+
+// newRecorder creates the output directory for roomID and returns a
+// Recorder ready to record tracks into it.
+func newRecorder(roomID string) (*Recorder, error) {
+	start := time.Now().Unix()
+	dir := filepath.Join(recordingsDir, roomID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("recorder: %w", err)
+	}
+	return &Recorder{
+		roomID:    roomID,
+		dir:       dir,
+		startUnix: start,
+		tracks:    make(map[*upTrack]*recordedTrack),
+	}, nil
+}
+
+// record starts writing ut to disk under a filename identifying the room,
+// this recording's start time and userID, so a participant who joins after
+// recording has already started gets their own file beginning at their
+// join time rather than a backfilled one.
+func (rec *Recorder) record(ut *upTrack, userID int) {
+	rt, err := newRecordedTrack(rec.dir, rec.roomID, rec.startUnix, userID, ut.track)
+	if err != nil {
+		log.Println("recorder:", err)
+		return
+	}
+
+	rec.mu.Lock()
+	rec.tracks[ut] = rt
+	rec.mu.Unlock()
+
+	ut.setRecordHook(rt.writeRTP)
+	ut.setEndHook(func() {
+		rec.mu.Lock()
+		delete(rec.tracks, ut)
+		rec.mu.Unlock()
+
+		ut.setRecordHook(nil)
+		ut.setEndHook(nil)
+		rt.close()
+	})
+}
+
+// close stops recording every track this Recorder is currently writing.
+func (rec *Recorder) close() {
+	rec.mu.Lock()
+	tracks := rec.tracks
+	rec.tracks = make(map[*upTrack]*recordedTrack)
+	rec.mu.Unlock()
+
+	for ut, rt := range tracks {
+		ut.setRecordHook(nil)
+		ut.setEndHook(nil)
+		rt.close()
+	}
+}
+
+// recordedTrack owns the on-disk writer for a single upTrack, rotating to a
+// new file once the current one passes maxRecordingFileSize.
+type recordedTrack struct {
+	mu       sync.Mutex
+	dir      string
+	baseName string // e.g. "room-1700000000-3-<trackID>"
+	ext      string // "ogg", "ivf" or "h264", per recordingExtension
+	track    *webrtc.Track
+
+	writer trackWriter
+	size   int64
+	part   int
+}
+
+// recordingExtension returns the container file extension recording a
+// track with the given codec name would use, and whether this pion build
+// actually ships a writer for it. VP9 has none here, so codecs.Name ==
+// webrtc.VP9 reports ok == false and the caller skips recording that track.
+func recordingExtension(codec string) (ext string, ok bool) {
+	switch codec {
+	case webrtc.Opus:
+		return "ogg", true
+	case webrtc.VP8:
+		return "ivf", true
+	case webrtc.H264:
+		return "h264", true
+	default:
+		return "", false
+	}
+}
+
+func newRecordedTrack(dir, roomID string, startUnix int64, userID int, track *webrtc.Track) (*recordedTrack, error) {
+	ext, ok := recordingExtension(track.Codec().Name)
+	if !ok {
+		return nil, fmt.Errorf("recorder: no writer for codec %q, skipping track %s", track.Codec().Name, track.ID())
+	}
+
+	// A user can publish more than one upTrack of the same kind at once —
+	// multiple video tracks (chunk0-3: webcam + screen share), or several
+	// simulcast layers of one (chunk0-5: q/h/f). Fold the track's own ID
+	// into the filename so those don't collide on disk.
+	rt := &recordedTrack{
+		dir:      dir,
+		baseName: fmt.Sprintf("%s-%d-%d-%s", roomID, startUnix, userID, sanitizeFileComponent(track.ID())),
+		ext:      ext,
+		track:    track,
+	}
+	if err := rt.openWriter(); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// sanitizeFileComponent replaces characters that aren't safe to use
+// unescaped in a filename (notably "/", which a track ID/msid could
+// contain) with "_".
+func sanitizeFileComponent(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// fileName returns the name (not path) of the part-th file for this track.
+func (rt *recordedTrack) fileName(part int) string {
+	if part == 0 {
+		return fmt.Sprintf("%s.%s", rt.baseName, rt.ext)
+	}
+	return fmt.Sprintf("%s-%d.%s", rt.baseName, part, rt.ext)
+}
+
+// openWriter opens a new container writer for the current part number.
+func (rt *recordedTrack) openWriter() error {
+	path := filepath.Join(rt.dir, rt.fileName(rt.part))
+	var (
+		w   trackWriter
+		err error
+	)
+	switch rt.track.Codec().Name {
+	case webrtc.Opus:
+		w, err = oggwriter.New(path, rt.track.Codec().ClockRate, rt.track.Codec().Channels)
+	case webrtc.VP8:
+		w, err = ivfwriter.New(path)
+	case webrtc.H264:
+		w, err = h264writer.New(path)
+	default:
+		return fmt.Errorf("recorder: no writer for codec %q", rt.track.Codec().Name)
+	}
+	if err != nil {
+		return fmt.Errorf("recorder: open %s: %w", path, err)
+	}
+	rt.writer = w
+	rt.size = 0
+	return nil
+}
+
+// writeRTP writes pkt to the current file, rotating to a new one first if
+// doing so would push the current file past maxRecordingFileSize.
+func (rt *recordedTrack) writeRTP(pkt *rtp.Packet) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if rt.size > 0 && rt.size+int64(len(pkt.Payload)) > maxRecordingFileSize {
+		if err := rt.writer.Close(); err != nil {
+			log.Println("recorder: close for rotation:", err)
+		}
+		rt.part++
+		if err := rt.openWriter(); err != nil {
+			log.Println("recorder:", err)
+			return
+		}
+	}
+
+	if err := rt.writer.WriteRTP(pkt); err != nil {
+		log.Println("recorder: write:", err)
+		return
+	}
+	rt.size += int64(len(pkt.Payload))
+}
+
+// close closes the current file.
+func (rt *recordedTrack) close() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if err := rt.writer.Close(); err != nil {
+		log.Println("recorder: close:", err)
+	}
+}
+
+// handleRecordings serves GET /recordings/{room} (a JSON listing of that
+// room's recorded files) and GET /recordings/{room}/{file} (the file
+// itself; http.ServeFile handles Range requests for us).
+func handleRecordings(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/recordings/")
+	parts := strings.SplitN(path, "/", 2)
+	room := parts[0]
+	if room == "" {
+		http.NotFound(w, r)
+		return
+	}
+	dir := filepath.Join(recordingsDir, room)
+
+	if len(parts) == 1 || parts[1] == "" {
+		listRecordings(w, dir)
+		return
+	}
+
+	file := filepath.Base(parts[1]) // guard against path traversal
+	http.ServeFile(w, r, filepath.Join(dir, file))
+}
+
+// listRecordings writes a JSON array of dir's recording file names.
+func listRecordings(w http.ResponseWriter, dir string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			io.WriteString(w, "[]")
+			return
+		}
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	if err := json.NewEncoder(w).Encode(names); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+	}
+}
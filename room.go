@@ -0,0 +1,144 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// Rooms is a registry of Room instances keyed by room ID. Rooms are created
+// lazily the first time a peer connects to them and live for as long as the
+// process runs.
+type Rooms struct {
+	mu    sync.RWMutex
+	rooms map[string]*Room
+}
+
+// NewRooms creates an empty room registry.
+func NewRooms() *Rooms {
+	return &Rooms{rooms: make(map[string]*Room)}
+}
+
+// GetOrCreate returns the room for id, creating it if this is the first
+// peer to reference it.
+func (rs *Rooms) GetOrCreate(id string) *Room {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	room, ok := rs.rooms[id]
+	if !ok {
+		room = &Room{ID: id, users: make(map[int]*User)}
+		rs.rooms[id] = room
+	}
+	return room
+}
+
+// Room is a voice-and-text chat room. Users are added when their websocket
+// connects and removed when it drops.
+type Room struct {
+	ID string
+
+	mu    sync.RWMutex
+	users map[int]*User
+
+	recMu    sync.RWMutex
+	recorder *Recorder
+}
+
+// GetUsers returns a snapshot of the room's current members.
+func (r *Room) GetUsers() []*User {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	users := make([]*User, 0, len(r.users))
+	for _, u := range r.users {
+		users = append(users, u)
+	}
+	return users
+}
+
+// GetOtherUsers returns every room member except u.
+func (r *Room) GetOtherUsers(u *User) []*User {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	users := make([]*User, 0, len(r.users))
+	for _, other := range r.users {
+		if other.ID == u.ID {
+			continue
+		}
+		users = append(users, other)
+	}
+	return users
+}
+
+// Join adds u to the room.
+func (r *Room) Join(u *User) {
+	r.mu.Lock()
+	r.users[u.ID] = u
+	r.mu.Unlock()
+}
+
+// Leave removes u from the room. It is a no-op if u isn't a member. If this
+// was the room's last member, any active recording is stopped too.
+func (r *Room) Leave(u *User) {
+	r.mu.Lock()
+	delete(r.users, u.ID)
+	empty := len(r.users) == 0
+	r.mu.Unlock()
+
+	if empty {
+		r.StopRecording()
+	}
+}
+
+// Recorder returns the room's currently active Recorder, or nil if the room
+// isn't being recorded.
+func (r *Room) Recorder() *Recorder {
+	r.recMu.RLock()
+	defer r.recMu.RUnlock()
+	return r.recorder
+}
+
+// StartRecording begins writing every track currently published in the
+// room to disk, along with any published afterwards, until StopRecording is
+// called or the room empties. It's a no-op if the room is already recording.
+func (r *Room) StartRecording() error {
+	r.recMu.Lock()
+	if r.recorder != nil {
+		r.recMu.Unlock()
+		return nil
+	}
+	rec, err := newRecorder(r.ID)
+	if err != nil {
+		r.recMu.Unlock()
+		return err
+	}
+	r.recorder = rec
+	r.recMu.Unlock()
+
+	for _, u := range r.GetUsers() {
+		for _, ut := range u.UpTracks() {
+			rec.record(ut, u.ID)
+		}
+	}
+	return nil
+}
+
+// StopRecording stops the room's active Recorder, if any, closing every
+// file it has open.
+func (r *Room) StopRecording() {
+	r.recMu.Lock()
+	rec := r.recorder
+	r.recorder = nil
+	r.recMu.Unlock()
+
+	if rec != nil {
+		rec.close()
+	}
+}
+
+// Broadcast sends body to every user currently in the room.
+func (r *Room) Broadcast(body interface{}) {
+	for _, u := range r.GetUsers() {
+		if err := u.SendJSON(body); err != nil {
+			log.Println("room broadcast:", err)
+		}
+	}
+}
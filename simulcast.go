@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pion/sdp/v2"
+	"github.com/pion/webrtc/v2"
+)
+
+// simulcastLayerOrder is the ascending quality order we expect a publisher's
+// declared RIDs to follow (the "q/h/f" convention most simulcast senders
+// use). simulcastGroup.best never picks a layer not named here, so such a
+// layer only reaches subscribers while it is its group's representative and
+// the group has no named layer for the scheduler to switch to.
+var simulcastLayerOrder = []string{"q", "h", "f"}
+
+// simulcastLayerMaxBitrate is a static, documented guess at each layer's
+// peak bitrate, used to pick a starting layer for a given bandwidth
+// estimate. Real encoders vary; this is a best-effort table, not a
+// negotiated value.
+var simulcastLayerMaxBitrate = map[string]uint64{
+	"q": 150_000,
+	"h": 500_000,
+	"f": 1_200_000,
+}
+
+// parseSimulcastRIDs reads the declared simulcast RIDs (a=rid ... send) out
+// of offer, keyed by each media section's MediaStream id (the same value
+// pion surfaces as a remote Track's Label()), in the order they were
+// declared.
+//
+// pion v2 doesn't demux simulcast layers by RTP header extension RID the
+// way a modern SFU would; it only ever hands us separate Tracks when a
+// publisher sends separate SSRCs (legacy SSRC-based simulcast, or several
+// a=ssrc lines under one m= section). We use the declared RID order here
+// purely to label whichever upTracks show up under the same stream, in the
+// order they arrive. That's an approximation, not true RID demuxing.
+func parseSimulcastRIDs(offer webrtc.SessionDescription) map[string][]string {
+	var parsed sdp.SessionDescription
+	if err := parsed.Unmarshal([]byte(offer.SDP)); err != nil {
+		return nil
+	}
+
+	rids := map[string][]string{}
+	for _, m := range parsed.MediaDescriptions {
+		label := mediaStreamLabel(m)
+		if label == "" {
+			continue
+		}
+		for _, a := range m.Attributes {
+			if a.Key != "rid" {
+				continue
+			}
+			fields := strings.Fields(a.Value)
+			if len(fields) < 2 || fields[1] != "send" {
+				continue
+			}
+			rids[label] = append(rids[label], fields[0])
+		}
+	}
+	return rids
+}
+
+// mediaStreamLabel returns m's MediaStream id, parsed the same way pion
+// derives a remote Track's Label() (from a=msid, or an a=ssrc ... msid:
+// line), so the two can be matched up later.
+func mediaStreamLabel(m *sdp.MediaDescription) string {
+	if v, ok := m.Attribute(sdp.AttrKeyMsid); ok {
+		if fields := strings.Fields(v); len(fields) > 0 {
+			return fields[0]
+		}
+	}
+	for _, a := range m.Attributes {
+		if a.Key != sdp.AttrKeySSRC {
+			continue
+		}
+		fields := strings.Fields(a.Value)
+		for i, f := range fields {
+			if strings.HasPrefix(f, "msid:") && i+1 < len(fields) {
+				return strings.TrimPrefix(f, "msid:")
+			}
+		}
+	}
+	return ""
+}
+
+// simulcastGroup holds the layers of a single simulcast publication, keyed
+// by RID, so subscribers can be switched between them as bandwidth changes.
+type simulcastGroup struct {
+	mu     sync.RWMutex
+	layers map[string]*upTrack
+
+	// representative is the one layer new subscribers are ever handed a
+	// downTrack for — whichever upTrack was added to the group first. All
+	// subsequent layer changes happen on that single downTrack via
+	// downTrack.switchTo; the group's other layers exist only to be
+	// switched to, never subscribed to directly, so a subscriber is never
+	// handed several duplicate video tracks for one logical stream.
+	representative *upTrack
+}
+
+func newSimulcastGroup() *simulcastGroup {
+	return &simulcastGroup{layers: make(map[string]*upTrack)}
+}
+
+// add registers ut as the upTrack for rid within the group, and reports
+// whether ut is the group's representative layer.
+func (g *simulcastGroup) add(rid string, ut *upTrack) (representative bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.layers[rid] = ut
+	if g.representative == nil {
+		g.representative = ut
+	}
+	return g.representative == ut
+}
+
+// isRepresentative reports whether ut is the group's representative layer.
+func (g *simulcastGroup) isRepresentative(ut *upTrack) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.representative == ut
+}
+
+// best returns the highest-quality layer currently in the group whose
+// documented max bitrate fits within availableBps, falling back to the
+// lowest layer present if none do (so a subscriber always gets something
+// rather than nothing while bandwidth is scarce).
+func (g *simulcastGroup) best(availableBps uint64) *upTrack {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	var best *upTrack
+	for _, rid := range simulcastLayerOrder {
+		ut, ok := g.layers[rid]
+		if !ok {
+			continue
+		}
+		if best == nil {
+			best = ut // lowest layer present, used as the fallback
+		}
+		if simulcastLayerMaxBitrate[rid] <= availableBps {
+			best = ut
+		}
+	}
+	return best
+}
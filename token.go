@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// joinTokenSecret is the HMAC key used to sign and verify room-join tokens.
+// It must be set via JOIN_TOKEN_SECRET in any deployment reachable outside a
+// trusted LAN — an empty secret makes every token trivial to forge.
+var joinTokenSecret = []byte(os.Getenv("JOIN_TOKEN_SECRET"))
+
+// adminSecret gates POST /token, the only way to mint a join token. It must
+// be set via ADMIN_SECRET in any deployment that exposes this endpoint; an
+// unset adminSecret makes handleMintToken refuse every request rather than
+// minting unauthenticated tokens.
+var adminSecret = os.Getenv("ADMIN_SECRET")
+
+// defaultTokenTTL is how long a minted join token is valid for when the
+// mint request doesn't specify its own ttlSeconds.
+const defaultTokenTTL = 24 * time.Hour
+
+// Permissions controls what a joining peer is allowed to do in a room.
+type Permissions struct {
+	PublishAudio bool `json:"publishAudio"`
+	PublishVideo bool `json:"publishVideo"`
+}
+
+// joinClaims is the payload signed into a room-join token.
+type joinClaims struct {
+	RoomID      string      `json:"roomID"`
+	UserID      string      `json:"userID"`
+	Expiry      int64       `json:"expiry"`
+	Permissions Permissions `json:"permissions"`
+}
+
+// signJoinToken builds a signed token for claims, of the form
+// "<base64url-json-claims>.<base64url-hmac>".
+func signJoinToken(claims joinClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encodedClaims := base64.RawURLEncoding.EncodeToString(payload)
+	return encodedClaims + "." + signClaims(encodedClaims), nil
+}
+
+// verifyJoinToken checks token's signature, room and expiry, returning the
+// claims it carries (in particular the granted Permissions) if valid.
+func verifyJoinToken(token, roomID string) (joinClaims, error) {
+	var claims joinClaims
+
+	encodedClaims, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims, errors.New("malformed join token")
+	}
+	if !hmac.Equal([]byte(signClaims(encodedClaims)), []byte(sig)) {
+		return claims, errors.New("invalid join token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedClaims)
+	if err != nil {
+		return claims, fmt.Errorf("malformed join token: %w", err)
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, fmt.Errorf("malformed join token: %w", err)
+	}
+
+	if claims.RoomID != roomID {
+		return claims, errors.New("join token is for a different room")
+	}
+	if time.Now().Unix() > claims.Expiry {
+		return claims, errors.New("join token has expired")
+	}
+	return claims, nil
+}
+
+func signClaims(encodedClaims string) string {
+	mac := hmac.New(sha256.New, joinTokenSecret)
+	mac.Write([]byte(encodedClaims))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// mintTokenRequest is the JSON body POST /token expects.
+type mintTokenRequest struct {
+	RoomID      string      `json:"roomID"`
+	UserID      string      `json:"userID"`
+	TTLSeconds  int64       `json:"ttlSeconds"`
+	Permissions Permissions `json:"permissions"`
+}
+
+// handleMintToken mints a signed join token for the room and permissions
+// given in the request body, for a deployment's own admin tooling to hand
+// out to peers. The caller authenticates via the X-Admin-Secret header,
+// checked against adminSecret.
+func handleMintToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if adminSecret == "" || !hmac.Equal([]byte(r.Header.Get("X-Admin-Secret")), []byte(adminSecret)) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req mintTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.RoomID == "" {
+		http.Error(w, "roomID is required", http.StatusBadRequest)
+		return
+	}
+
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = defaultTokenTTL
+	}
+
+	token, err := signJoinToken(joinClaims{
+		RoomID:      req.RoomID,
+		UserID:      req.UserID,
+		Expiry:      time.Now().Add(ttl).Unix(),
+		Permissions: req.Permissions,
+	})
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Token string `json:"token"`
+	}{Token: token}); err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+const (
+	// packetCacheSize is how many of an upTrack's most recent RTP packets
+	// are kept around so a downTrack's NACK can be serviced without going
+	// back to the publisher.
+	packetCacheSize = 512
+
+	// receiverReportInterval is how often an upTrack sends an RTCP receiver
+	// report back to its publisher.
+	receiverReportInterval = 2 * time.Second
+
+	// keyFrameInterval bounds how often a PLI/FIR from subscribers is
+	// forwarded to the publisher, so a burst of requests collapses into one.
+	keyFrameInterval = 500 * time.Millisecond
+
+	// bweWindow is the rolling window a downTrack's bandwidth estimator
+	// measures its own outgoing bitrate over.
+	bweWindow = time.Second
+
+	// initialEstimateBps is the bandwidth a downTrack's estimator starts
+	// at, before any REMB/TWCC/loss feedback has arrived.
+	initialEstimateBps = 300_000
+
+	// aimdIncreaseBps is how much a positive feedback signal grows the
+	// estimate by (the "additive increase" half of AIMD).
+	aimdIncreaseBps = 50_000
+
+	// aimdDecreaseFactor is what the estimate is multiplied by on a REMB
+	// drop or >2% reported loss (the "multiplicative decrease" half).
+	aimdDecreaseFactor = 0.85
+
+	// layerSwitchInterval is how often a simulcast subscriber's downTrack
+	// re-evaluates which layer its current bandwidth estimate affords.
+	layerSwitchInterval = 3 * time.Second
+
+	// bweSentHeadroom is how far above a downTrack's recently measured real
+	// outgoing bitrate (sentBps) the estimate is allowed to grow. Without
+	// this, REMB/TWCC/loss feedback alone could keep growing the estimate
+	// indefinitely even though this downTrack has never actually managed to
+	// put that much data on the wire; the headroom still leaves room to
+	// probe a higher simulcast layer once one becomes available.
+	bweSentHeadroom = 1.5
+)
+
+// cachedPacket is a single RTP packet kept around for NACK retransmission.
+type cachedPacket struct {
+	seq     uint16
+	header  rtp.Header
+	payload []byte
+}
+
+// packetCache is a fixed-size ring of an upTrack's most recently forwarded
+// packets, keyed by sequence number.
+type packetCache struct {
+	mu      sync.Mutex
+	packets [packetCacheSize]*cachedPacket
+}
+
+func (c *packetCache) store(pkt *rtp.Packet) {
+	c.mu.Lock()
+	c.packets[pkt.SequenceNumber%packetCacheSize] = &cachedPacket{
+		seq:     pkt.SequenceNumber,
+		header:  pkt.Header,
+		payload: append([]byte(nil), pkt.Payload...),
+	}
+	c.mu.Unlock()
+}
+
+func (c *packetCache) get(seq uint16) *cachedPacket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached := c.packets[seq%packetCacheSize]
+	if cached == nil || cached.seq != seq {
+		return nil
+	}
+	return cached
+}
+
+// jitter estimates inter-arrival jitter for a track per RFC 3550 section
+// 6.4.1: J(i) = J(i-1) + (|D(i-1,i)| - J(i-1))/16.
+type jitter struct {
+	mu sync.Mutex
+
+	clockRate     uint32
+	initialized   bool
+	lastArrival   int64
+	lastTimestamp uint32
+	estimate      float64
+}
+
+func newJitter(clockRate uint32) *jitter {
+	return &jitter{clockRate: clockRate}
+}
+
+// update folds pkt's arrival into the running estimate and returns it, in
+// clock-rate units as RTCP reports expect.
+func (j *jitter) update(pkt *rtp.Packet) uint32 {
+	arrival := time.Now().UnixNano() * int64(j.clockRate) / int64(time.Second)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.initialized {
+		d := float64(arrival-j.lastArrival) - float64(int64(pkt.Timestamp)-int64(j.lastTimestamp))
+		if d < 0 {
+			d = -d
+		}
+		j.estimate += (d - j.estimate) / 16
+	}
+	j.lastArrival = arrival
+	j.lastTimestamp = pkt.Timestamp
+	j.initialized = true
+	return uint32(j.estimate)
+}
+
+// value returns the current jitter estimate without folding in a new packet.
+func (j *jitter) value() uint32 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return uint32(j.estimate)
+}
+
+// receptionStats tracks enough per-upTrack reception state to fill in an
+// RTCP receiver report: packets received, highest sequence number seen, and
+// loss since the previous report.
+type receptionStats struct {
+	mu sync.Mutex
+
+	initialized bool
+	baseSeq     uint16
+	highestSeq  uint16
+	received    uint32
+
+	reportedReceived uint32
+	reportedExpected uint32
+}
+
+func (s *receptionStats) update(pkt *rtp.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.initialized {
+		s.baseSeq = pkt.SequenceNumber
+		s.highestSeq = pkt.SequenceNumber
+		s.initialized = true
+	} else if int16(pkt.SequenceNumber-s.highestSeq) > 0 {
+		s.highestSeq = pkt.SequenceNumber
+	}
+	s.received++
+}
+
+// report builds a ReceptionReport for ssrc covering packets since the
+// previous call.
+func (s *receptionStats) report(ssrc uint32, jitter uint32) rtcp.ReceptionReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expected := uint32(s.highestSeq-s.baseSeq) + 1
+	var fraction uint8
+	if expectedInterval := expected - s.reportedExpected; expectedInterval > 0 {
+		receivedInterval := s.received - s.reportedReceived
+		if expectedInterval > receivedInterval {
+			fraction = uint8(((expectedInterval - receivedInterval) * 256) / expectedInterval)
+		}
+	}
+	s.reportedExpected = expected
+	s.reportedReceived = s.received
+
+	var totalLost uint32
+	if expected > s.received {
+		totalLost = expected - s.received
+	}
+
+	return rtcp.ReceptionReport{
+		SSRC:               ssrc,
+		FractionLost:       fraction,
+		TotalLost:          totalLost,
+		LastSequenceNumber: uint32(s.highestSeq),
+		Jitter:             jitter,
+	}
+}
+
+// upTrack wraps a track a single user publishes into a room. It caches
+// recently forwarded packets to service subscriber NACKs, estimates jitter
+// and loss, and fans out incoming RTP to every subscribed downTrack.
+type upTrack struct {
+	owner *User
+	track *webrtc.Track
+
+	cache  *packetCache
+	jitter *jitter
+	stats  *receptionStats
+
+	downTracksLock sync.RWMutex
+	downTracks     map[uint32]*downTrack
+
+	lastKeyFrameLock sync.Mutex
+	lastKeyFrame     time.Time
+
+	// layer is this upTrack's simulcast RID ("q"/"h"/"f"), and group is the
+	// simulcastGroup it belongs to. Both are empty/nil for a non-simulcast
+	// publication.
+	layer string
+	group *simulcastGroup
+
+	// recordLock guards onRecord and onEnd: an optional hook invoked with
+	// every packet forward() reads, and an optional hook invoked once
+	// forward() returns because the publisher stopped sending. A Recorder
+	// uses these to write this upTrack to disk and close its file promptly
+	// when the track ends.
+	recordLock sync.RWMutex
+	onRecord   func(*rtp.Packet)
+	onEnd      func()
+}
+
+// newUpTrack wraps remoteTrack and starts forwarding its RTP to subscribers
+// and generating periodic receiver reports back to owner.
+func newUpTrack(owner *User, remoteTrack *webrtc.Track) *upTrack {
+	ut := &upTrack{
+		owner:      owner,
+		track:      remoteTrack,
+		cache:      &packetCache{},
+		jitter:     newJitter(remoteTrack.Codec().ClockRate),
+		stats:      &receptionStats{},
+		downTracks: make(map[uint32]*downTrack),
+	}
+	go ut.forward()
+	go ut.sendReceiverReports()
+	return ut
+}
+
+// forward reads RTP from the publisher, caches and measures it, writes it
+// out to every current subscriber, and feeds it to an active Recorder's
+// hook, if any.
+func (ut *upTrack) forward() {
+	defer func() {
+		if hook := ut.endHook(); hook != nil {
+			hook()
+		}
+	}()
+	for {
+		pkt, err := ut.track.ReadRTP()
+		if err != nil {
+			if err != io.EOF {
+				log.Println("upTrack forward:", err)
+			}
+			return
+		}
+
+		ut.cache.store(pkt)
+		ut.stats.update(pkt)
+		ut.jitter.update(pkt)
+
+		for _, dt := range ut.subscribers() {
+			if err := dt.writeRTP(pkt); err != nil {
+				log.Println("downTrack write:", err)
+			}
+		}
+
+		if hook := ut.recordHook(); hook != nil {
+			hook(pkt)
+		}
+	}
+}
+
+// setRecordHook installs fn to be called with every packet this upTrack
+// forwards, alongside its normal subscribers. Passing nil removes it.
+func (ut *upTrack) setRecordHook(fn func(pkt *rtp.Packet)) {
+	ut.recordLock.Lock()
+	ut.onRecord = fn
+	ut.recordLock.Unlock()
+}
+
+func (ut *upTrack) recordHook() func(pkt *rtp.Packet) {
+	ut.recordLock.RLock()
+	defer ut.recordLock.RUnlock()
+	return ut.onRecord
+}
+
+// setEndHook installs fn to be called once this upTrack's forward loop
+// returns because the publisher stopped sending. Passing nil removes it.
+func (ut *upTrack) setEndHook(fn func()) {
+	ut.recordLock.Lock()
+	ut.onEnd = fn
+	ut.recordLock.Unlock()
+}
+
+func (ut *upTrack) endHook() func() {
+	ut.recordLock.RLock()
+	defer ut.recordLock.RUnlock()
+	return ut.onEnd
+}
+
+// sendReceiverReports periodically tells the publisher how reception of its
+// track is going, until the owning user's websocket closes (owner.stop). It
+// keeps running after forward() returns if the owner is still connected.
+func (ut *upTrack) sendReceiverReports() {
+	ticker := time.NewTicker(receiverReportInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if ut.owner.stop {
+			return
+		}
+		report := ut.stats.report(ut.track.SSRC(), ut.jitter.value())
+		err := ut.owner.pc.WriteRTCP([]rtcp.Packet{&rtcp.ReceiverReport{Reports: []rtcp.ReceptionReport{report}}})
+		if err != nil {
+			log.Println("upTrack receiver report:", err)
+		}
+	}
+}
+
+func (ut *upTrack) subscribers() []*downTrack {
+	ut.downTracksLock.RLock()
+	defer ut.downTracksLock.RUnlock()
+	out := make([]*downTrack, 0, len(ut.downTracks))
+	for _, dt := range ut.downTracks {
+		out = append(out, dt)
+	}
+	return out
+}
+
+// subscribe adds dt as a subscriber of ut.
+func (ut *upTrack) subscribe(dt *downTrack) {
+	ut.downTracksLock.Lock()
+	ut.downTracks[dt.track.SSRC()] = dt
+	ut.downTracksLock.Unlock()
+}
+
+// onSubscriberJoined nudges a freshly-subscribed video track towards a
+// prompt keyframe: a single PLI is easily lost or can race the encoder, so
+// we retry a couple of times over the next second rather than leaving a new
+// viewer staring at a blank frame until the publisher's next periodic one.
+func (ut *upTrack) onSubscriberJoined() {
+	if ut.track.Kind() != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	go func() {
+		for i := 0; i < 3; i++ {
+			ut.requestKeyFrame()
+			time.Sleep(keyFrameInterval)
+		}
+	}()
+}
+
+// unsubscribe removes the downTrack with local SSRC ssrc, if any.
+func (ut *upTrack) unsubscribe(ssrc uint32) {
+	ut.downTracksLock.Lock()
+	delete(ut.downTracks, ssrc)
+	ut.downTracksLock.Unlock()
+}
+
+// resend looks seq up in the packet cache and retransmits it on dt.
+func (ut *upTrack) resend(dt *downTrack, seq uint16) {
+	cached := ut.cache.get(seq)
+	if cached == nil {
+		return
+	}
+	if err := dt.writeRTP(&rtp.Packet{Header: cached.header, Payload: cached.payload}); err != nil {
+		log.Println("upTrack resend:", err)
+	}
+}
+
+// requestKeyFrame asks the publisher for a keyframe via PLI, collapsing a
+// burst of subscriber requests into at most one per keyFrameInterval.
+func (ut *upTrack) requestKeyFrame() {
+	ut.lastKeyFrameLock.Lock()
+	if time.Since(ut.lastKeyFrame) < keyFrameInterval {
+		ut.lastKeyFrameLock.Unlock()
+		return
+	}
+	ut.lastKeyFrame = time.Now()
+	ut.lastKeyFrameLock.Unlock()
+
+	err := ut.owner.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ut.track.SSRC()}})
+	if err != nil {
+		log.Println("upTrack requestKeyFrame:", err)
+	}
+}
+
+// downTrack is a local track a single subscriber receives an upTrack's
+// stream on.
+type downTrack struct {
+	owner *User
+	track *webrtc.Track
+
+	upLock sync.RWMutex
+	up     *upTrack
+
+	// group is non-nil when up is part of a simulcast publication, and lets
+	// this downTrack be switched between up's sibling layers.
+	group *simulcastGroup
+	bwe   *bweEstimator
+
+	done chan struct{}
+}
+
+func newDownTrack(owner *User, track *webrtc.Track, up *upTrack) *downTrack {
+	return &downTrack{
+		owner: owner,
+		track: track,
+		up:    up,
+		bwe:   newBWEEstimator(),
+		done:  make(chan struct{}),
+	}
+}
+
+// currentUp returns the upTrack this downTrack is presently receiving from.
+func (dt *downTrack) currentUp() *upTrack {
+	dt.upLock.RLock()
+	defer dt.upLock.RUnlock()
+	return dt.up
+}
+
+// writeRTP rewrites pkt's SSRC to this downTrack's local track and sends it.
+func (dt *downTrack) writeRTP(pkt *rtp.Packet) error {
+	out := *pkt
+	out.Header.SSRC = dt.track.SSRC()
+	dt.bwe.onSent(len(out.Payload))
+	return dt.track.WriteRTP(&out)
+}
+
+// handleRTCP services NACKs from the upTrack's packet cache, forwards
+// PLI/FIR keyframe requests up to the publisher, and folds REMB/loss
+// feedback into this downTrack's bandwidth estimate.
+func (dt *downTrack) handleRTCP(pkts []rtcp.Packet) {
+	for _, pkt := range pkts {
+		switch p := pkt.(type) {
+		case *rtcp.TransportLayerNack:
+			up := dt.currentUp()
+			for _, pair := range p.Nacks {
+				for _, seq := range pair.PacketList() {
+					up.resend(dt, seq)
+				}
+			}
+		case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+			dt.currentUp().requestKeyFrame()
+		case *rtcp.ReceiverEstimatedMaximumBitrate:
+			dt.bwe.onREMB(uint64(p.Bitrate))
+		case *rtcp.TransportLayerCC:
+			dt.bwe.onTWCC()
+		case *rtcp.ReceiverReport:
+			for _, r := range p.Reports {
+				if r.SSRC == dt.track.SSRC() {
+					dt.bwe.onLoss(r.FractionLost)
+				}
+			}
+		}
+	}
+}
+
+// switchTo moves dt from its current upTrack onto ut, a sibling layer in
+// the same simulcast group, unsubscribing from the old one and requesting
+// a keyframe from the new one so the subscriber doesn't wait for its next
+// periodic one.
+func (dt *downTrack) switchTo(ut *upTrack) {
+	dt.upLock.Lock()
+	old := dt.up
+	dt.up = ut
+	dt.upLock.Unlock()
+
+	if old == ut {
+		return
+	}
+	if old != nil {
+		old.unsubscribe(dt.track.SSRC())
+	}
+	ut.subscribe(dt)
+	ut.requestKeyFrame()
+
+	if dt.owner != nil {
+		if err := dt.owner.SendJSON(Event{Type: "layer", Layer: ut.layer, Bitrate: dt.bwe.value()}); err != nil {
+			log.Println("downTrack switchTo notify:", err)
+		}
+	}
+}
+
+// runLayerScheduler periodically switches dt to the highest simulcast
+// layer its current bandwidth estimate affords, until dt is closed. It's a
+// no-op for a downTrack that isn't part of a simulcast group.
+func (dt *downTrack) runLayerScheduler() {
+	if dt.group == nil {
+		return
+	}
+	ticker := time.NewTicker(layerSwitchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-dt.done:
+			return
+		case <-ticker.C:
+			if best := dt.group.best(dt.bwe.value()); best != nil && best != dt.currentUp() {
+				dt.switchTo(best)
+			}
+		}
+	}
+}
+
+// close stops dt's layer scheduler (if any) and unsubscribes it from
+// whatever upTrack it currently receives from.
+func (dt *downTrack) close() {
+	select {
+	case <-dt.done:
+	default:
+		close(dt.done)
+	}
+	dt.currentUp().unsubscribe(dt.track.SSRC())
+}
+
+// bweEstimator is a minimal per-downTrack bandwidth estimator. It tracks
+// this downTrack's own outgoing bitrate over a rolling window, and adjusts
+// an AIMD estimate of what the subscriber's path can currently afford from
+// REMB/TWCC/loss feedback: grow a little on good feedback, back off by
+// aimdDecreaseFactor on a REMB drop or >2% reported loss. Growth is capped
+// by bweSentHeadroom above sentBps, the rolling window's measured real
+// throughput, so the estimate stays grounded in what this downTrack has
+// actually managed to send rather than floating up on feedback alone.
+type bweEstimator struct {
+	mu sync.Mutex
+
+	windowStart int64 // unix nano
+	windowBytes uint64
+	sentBps     uint64 // measured over the last full window
+
+	estimate uint64 // bits/sec
+}
+
+func newBWEEstimator() *bweEstimator {
+	return &bweEstimator{estimate: initialEstimateBps}
+}
+
+// onSent folds n bytes just written to the wire into the rolling window
+// used to measure this downTrack's own outgoing bitrate.
+func (e *bweEstimator) onSent(n int) {
+	now := time.Now().UnixNano()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.windowStart == 0 {
+		e.windowStart = now
+	} else if now-e.windowStart > int64(bweWindow) {
+		e.sentBps = e.windowBytes * 8 * uint64(time.Second) / uint64(bweWindow)
+		e.windowBytes = 0
+		e.windowStart = now
+	}
+	e.windowBytes += uint64(n)
+}
+
+// grow adds delta to the estimate, then clamps it back down to
+// bweSentHeadroom above sentBps if that measured throughput is lower —
+// called with e.mu already held.
+func (e *bweEstimator) grow(delta uint64) {
+	e.estimate += delta
+	if e.sentBps == 0 {
+		return
+	}
+	if cap := uint64(float64(e.sentBps) * bweSentHeadroom); e.estimate > cap {
+		e.estimate = cap
+	}
+}
+
+// onREMB folds a subscriber's REMB report into the estimate.
+func (e *bweEstimator) onREMB(bitrate uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if bitrate < e.estimate {
+		e.estimate = uint64(float64(e.estimate) * aimdDecreaseFactor)
+		return
+	}
+	e.grow(aimdIncreaseBps)
+	if e.estimate > bitrate {
+		e.estimate = bitrate
+	}
+}
+
+// onLoss folds a subscriber's reported fraction lost (0-255, per RTCP
+// receiver report) into the estimate.
+func (e *bweEstimator) onLoss(fraction uint8) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if float64(fraction)/256 > 0.02 {
+		e.estimate = uint64(float64(e.estimate) * aimdDecreaseFactor)
+		return
+	}
+	e.grow(aimdIncreaseBps)
+}
+
+// onTWCC treats the arrival of transport-wide congestion control feedback
+// as a liveliness signal and nudges the estimate up. A full TWCC delay-
+// gradient estimator is out of scope here.
+func (e *bweEstimator) onTWCC() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.grow(aimdIncreaseBps / 5)
+}
+
+// value returns the estimator's current bandwidth estimate, in bits/sec.
+func (e *bweEstimator) value() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.estimate
+}
@@ -5,15 +5,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/pion/rtp"
+	"github.com/pion/sdp/v2"
 	"github.com/pion/webrtc/v2"
 )
 
@@ -25,9 +25,6 @@ var (
 
 	setting webrtc.SettingEngine
 
-	errChanClosed     = errors.New("channel closed")
-	errInvalidTrack   = errors.New("track is nil")
-	errInvalidPacket  = errors.New("packet is nil")
 	errInvalidPC      = errors.New("pc is nil")
 	errInvalidOptions = errors.New("invalid options")
 )
@@ -63,24 +60,134 @@ type User struct {
 	conn *websocket.Conn        // The websocket connection.
 	send chan []byte            // Buffered channel of outbound messages.
 	pc   *webrtc.PeerConnection // WebRTC Peer Connection
-	// Tracks         map[uint32]*webrtc.Track // WebRTC incoming audio tracks
-	// Track *webrtc.Track
-	// inTracks      map[uint32]*webrtc.Track
-	inTrack       *webrtc.Track
-	inTracksLock  sync.RWMutex
-	outTracks     map[uint32]*webrtc.Track
+
+	upTracks     map[string]*upTrack // tracks this user publishes, keyed by track ID
+	upTracksLock sync.RWMutex
+
+	outTracks     map[uint32]*downTrack // tracks this user subscribes to, keyed by local SSRC
 	outTracksLock sync.RWMutex
 
-	rtpCh chan *rtp.Packet
+	// simulcastRIDs holds, per published stream (keyed by MediaStream id),
+	// the RIDs declared in this user's first offer (the one initPeerConnection
+	// builds the PeerConnection from), in declaration order. Later
+	// renegotiation offers don't update it.
+	simulcastRIDs map[string][]string
+
+	// simulcastGroups and simulcastNextLayer track the simulcast
+	// publications this user owns: the group each stream's layers are
+	// collected into, and how many of its declared RIDs have been assigned
+	// to an arriving upTrack so far. See assignSimulcastLayer.
+	simulcastLock      sync.Mutex
+	simulcastGroups    map[string]*simulcastGroup
+	simulcastNextLayer map[string]int
+
+	nick     string
+	nickLock sync.RWMutex
+
+	permissions Permissions // granted by this user's room-join token
 
 	stop bool
+
+	// leaveOnce guards leaveRoom, which both an explicit "leave" event and
+	// readPump's deferred cleanup can trigger — whichever happens first
+	// should be the one that actually leaves the room and broadcasts it.
+	leaveOnce sync.Once
+}
+
+// Nick returns the user's current chosen nickname, falling back to a
+// guest name derived from their ID if they haven't set one yet.
+func (u *User) Nick() string {
+	u.nickLock.RLock()
+	defer u.nickLock.RUnlock()
+	if u.nick == "" {
+		return fmt.Sprintf("guest-%d", u.ID)
+	}
+	return u.nick
+}
+
+// SetNick sets the user's chosen nickname.
+func (u *User) SetNick(nick string) {
+	u.nickLock.Lock()
+	u.nick = nick
+	u.nickLock.Unlock()
+}
+
+// UpTracks returns a snapshot of the tracks this user currently publishes.
+func (u *User) UpTracks() map[string]*upTrack {
+	u.upTracksLock.RLock()
+	defer u.upTracksLock.RUnlock()
+	out := make(map[string]*upTrack, len(u.upTracks))
+	for id, ut := range u.upTracks {
+		out[id] = ut
+	}
+	return out
+}
+
+// AddUpTrack registers a track this user publishes under id.
+func (u *User) AddUpTrack(id string, ut *upTrack) {
+	u.upTracksLock.Lock()
+	if u.upTracks == nil {
+		u.upTracks = make(map[string]*upTrack)
+	}
+	u.upTracks[id] = ut
+	u.upTracksLock.Unlock()
+}
+
+// assignSimulcastLayer returns the RID the next upTrack to arrive for the
+// stream identified by label should be treated as, and whether it's part of
+// a simulcast publication at all (ok is false if label declared no RIDs).
+//
+// pion v2 doesn't surface a remote Track's RID, so true RID demuxing isn't
+// possible here; we assign declared RIDs in order as OnTrack fires for each
+// additional SSRC under the same stream. That matches how this pion version
+// actually demuxes legacy SSRC-based simulcast (a separate OnTrack per
+// a=ssrc line, all sharing one a=msid), but is only an approximation for a
+// modern RID-extension-based sender.
+func (u *User) assignSimulcastLayer(label string) (rid string, ok bool) {
+	rids := u.simulcastRIDs[label]
+	if len(rids) == 0 {
+		return "", false
+	}
+
+	u.simulcastLock.Lock()
+	defer u.simulcastLock.Unlock()
+	if u.simulcastNextLayer == nil {
+		u.simulcastNextLayer = make(map[string]int)
+	}
+	idx := u.simulcastNextLayer[label]
+	u.simulcastNextLayer[label]++
+	if idx >= len(rids) {
+		return "", false
+	}
+	return rids[idx], true
+}
+
+// getOrCreateSimulcastGroup returns the simulcastGroup this user's stream
+// label is being collected into, creating it on first use.
+func (u *User) getOrCreateSimulcastGroup(label string) *simulcastGroup {
+	u.simulcastLock.Lock()
+	defer u.simulcastLock.Unlock()
+	if u.simulcastGroups == nil {
+		u.simulcastGroups = make(map[string]*simulcastGroup)
+	}
+	group, ok := u.simulcastGroups[label]
+	if !ok {
+		group = newSimulcastGroup()
+		u.simulcastGroups[label] = group
+	}
+	return group
+}
+
+// Roster returns the roster entry describing this user.
+func (u *User) Roster() Roster {
+	return Roster{ID: u.ID, Nick: u.Nick()}
 }
 
 // readPump pumps messages from the websocket connection to the hub.
 func (u *User) readPump() {
 	defer func() {
 		u.stop = true
-		u.room.Leave(u)
+		u.leaveRoom()
 		u.conn.Close()
 	}()
 	u.conn.SetReadLimit(maxMessageSize)
@@ -153,6 +260,27 @@ type Event struct {
 	Answer    *webrtc.SessionDescription `json:"answer,omitempty"`
 	Candidate *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
 	Desc      string                     `json:"desc,omitempty"`
+
+	Nick  string   `json:"nick,omitempty"`
+	Msg   string   `json:"msg,omitempty"`
+	HTML  string   `json:"html,omitempty"`
+	Users []Roster `json:"users,omitempty"`
+
+	// Layer and Bitrate describe a "layer" event: a simulcast subscriber's
+	// downTrack just switched to a new layer, with Bitrate its current
+	// bandwidth estimate in bits/sec.
+	Layer   string `json:"layer,omitempty"`
+	Bitrate uint64 `json:"bitrate,omitempty"`
+
+	// On is whether a "record" event is turning the room's recording on or
+	// off.
+	On bool `json:"on,omitempty"`
+}
+
+// Roster describes a single room member for presence/roster broadcasts.
+type Roster struct {
+	ID   int    `json:"id"`
+	Nick string `json:"nick"`
 }
 
 // SendJSON sends json body to web socket
@@ -201,73 +329,244 @@ func (u *User) HandleEvent(eventRaw []byte) error {
 		log.Println("adding candidate", event.Candidate)
 		u.pc.AddICECandidate(*event.Candidate)
 		return nil
+	} else if event.Type == "join" {
+		return u.handleJoin(event)
+	} else if event.Type == "leave" {
+		u.leaveRoom()
+		return nil
+	} else if event.Type == "nick" {
+		return u.handleNick(event)
+	} else if event.Type == "chat" {
+		return u.handleChat(event)
+	} else if event.Type == "record" {
+		return u.handleRecord(event)
 	}
 
 	return u.SendErr(errors.New("not implemented"))
 }
 
-// GetRoomTracks returns list of room incoming tracks
-func (u *User) GetRoomTracks() []*webrtc.Track {
-	tracks := []*webrtc.Track{}
+// handleJoin records the nickname the peer chose for this room, sends them
+// a roster snapshot of who's already here, and broadcasts their presence to
+// the whole room, the joining user included.
+func (u *User) handleJoin(event *Event) error {
+	nick := strings.TrimSpace(event.Nick)
+	if nick == "" {
+		nick = u.Nick()
+	}
+	u.SetNick(nick)
+
+	roster := []Roster{}
+	for _, other := range u.room.GetOtherUsers(u) {
+		roster = append(roster, other.Roster())
+	}
+	if err := u.SendJSON(Event{Type: "roster", Users: roster}); err != nil {
+		return err
+	}
+
+	u.room.Broadcast(Event{Type: "presence", Desc: "join", Nick: nick})
+	return nil
+}
+
+// handleNick changes the user's nickname and broadcasts the change.
+func (u *User) handleNick(event *Event) error {
+	nick := strings.TrimSpace(event.Nick)
+	if nick == "" {
+		return u.SendErr(errors.New("empty nick"))
+	}
+	old := u.Nick()
+	u.SetNick(nick)
+	u.room.Broadcast(Event{Type: "nick", Nick: nick, Desc: old})
+	return nil
+}
+
+// handleChat renders the message's markdown and fans it out to the room.
+func (u *User) handleChat(event *Event) error {
+	if strings.TrimSpace(event.Msg) == "" {
+		return u.SendErr(errors.New("empty message"))
+	}
+	u.room.Broadcast(Event{
+		Type: "chat",
+		Nick: u.Nick(),
+		Msg:  event.Msg,
+		HTML: renderMarkdown(event.Msg),
+	})
+	return nil
+}
+
+// handleRecord starts or stops recording the user's room, per event.On, and
+// broadcasts the change to the room.
+func (u *User) handleRecord(event *Event) error {
+	if event.On {
+		if err := u.room.StartRecording(); err != nil {
+			return u.SendErr(err)
+		}
+	} else {
+		u.room.StopRecording()
+	}
+	u.room.Broadcast(Event{Type: "record", On: event.On})
+	return nil
+}
+
+// GetRoomTracks returns the tracks a new subscriber should receive one
+// downTrack for: every non-simulcast upTrack published by any user in the
+// room, u included (HandleOffer calls it before u has published any), plus exactly the representative layer of each simulcast
+// group — never all of a group's layers, which would hand the subscriber
+// several duplicate video tracks for what is logically one stream.
+func (u *User) GetRoomTracks() []*upTrack {
+	tracks := []*upTrack{}
 	for _, user := range u.room.GetUsers() {
-		if user.inTrack != nil {
-			tracks = append(tracks, user.inTrack)
+		for _, ut := range user.UpTracks() {
+			if ut.group != nil && !ut.group.isRepresentative(ut) {
+				continue
+			}
+			tracks = append(tracks, ut)
 		}
 	}
 	return tracks
 }
 
-func (u *User) supportOpus(offer webrtc.SessionDescription) bool {
+// initPeerConnection lazily builds u's PeerConnection the first time they
+// send an offer, with its MediaEngine restricted to whatever codecs that
+// offer itself negotiates (PopulateFromSDP only recognizes Opus, VP8, VP9
+// and H264, so that's also our allow-list). This lets a peer publish and
+// subscribe to any mix of those, not just a single hardcoded audio track.
+func (u *User) initPeerConnection(offer webrtc.SessionDescription) error {
 	mediaEngine := webrtc.MediaEngine{}
-	mediaEngine.PopulateFromSDP(offer)
-	var payloadType uint8
-	// Search for Payload type. If the offer doesn't support codec exit since
-	// since they won't be able to decode anything we send them
-	for _, audioCodec := range mediaEngine.GetCodecsByKind(webrtc.RTPCodecTypeAudio) {
-		if audioCodec.Name == "OPUS" {
-			payloadType = audioCodec.PayloadType
-			break
-		}
+	if err := mediaEngine.PopulateFromSDP(offer); err != nil {
+		return err
 	}
-	if payloadType == 0 {
-		return false
+
+	u.simulcastRIDs = parseSimulcastRIDs(offer)
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
+	pc, err := api.NewPeerConnection(PeerConnectionConfig())
+	if err != nil {
+		return err
 	}
-	return true
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		if err := u.SendCandidate(candidate); err != nil {
+			log.Println("fail send candidate", err)
+		}
+	})
+
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		log.Printf("user %d connection state: %s\n", u.ID, state)
+	})
+
+	pc.OnTrack(func(remoteTrack *webrtc.Track, receiver *webrtc.RTPReceiver) {
+		log.Printf("user %d published track %s (%s)\n", u.ID, remoteTrack.ID(), remoteTrack.Kind())
+		ut := newUpTrack(u, remoteTrack)
+		representative := true
+		if rid, ok := u.assignSimulcastLayer(remoteTrack.Label()); ok {
+			ut.layer = rid
+			ut.group = u.getOrCreateSimulcastGroup(remoteTrack.Label())
+			representative = ut.group.add(rid, ut)
+			log.Printf("user %d track %s is simulcast layer %q\n", u.ID, remoteTrack.ID(), rid)
+		}
+		u.AddUpTrack(remoteTrack.ID(), ut)
+		if rec := u.room.Recorder(); rec != nil {
+			rec.record(ut, u.ID)
+		}
+
+		if !representative {
+			// A non-representative simulcast layer isn't subscribed to
+			// directly: it only exists for the group's representative
+			// downTrack to switchTo later, as bandwidth allows.
+			return
+		}
+
+		for _, roomUser := range u.room.GetOtherUsers(u) {
+			if roomUser.pc == nil {
+				// Hasn't sent their own offer yet; they'll pick this track
+				// up via GetRoomTracks when they do.
+				continue
+			}
+			if _, err := roomUser.AddTrack(ut); err != nil {
+				log.Println("ERROR subscribing", roomUser.ID, "to", u.ID, ":", err)
+				continue
+			}
+			if err := roomUser.SendOffer(); err != nil {
+				log.Println("ERROR sending renegotiation offer to", roomUser.ID, ":", err)
+			}
+		}
+	})
+
+	u.pc = pc
+	return nil
 }
 
-// HandleOffer handles webrtc offer
+// HandleOffer handles a webrtc offer sent by a peer.
 func (u *User) HandleOffer(offer webrtc.SessionDescription) error {
-	if ok := u.supportOpus(offer); !ok {
-		return errors.New("remote peer does not support opus codec")
+	if err := u.checkPublishPermissions(offer); err != nil {
+		return u.SendErr(err)
 	}
-	tracks := u.GetRoomTracks()
-	if len(tracks) == 0 {
-		_, err := u.pc.AddTransceiver(webrtc.RTPCodecTypeAudio, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
-		if err != nil {
+
+	if u.pc == nil {
+		if err := u.initPeerConnection(offer); err != nil {
 			return err
 		}
-	}
-	fmt.Println("attach ", len(tracks), "tracks to new user")
-	for _, track := range tracks {
-		err := u.AddTrack(track.SSRC())
-		if err != nil {
-			log.Println("ERROR Add remote track as peerConnection local track", err)
-			panic(err)
+
+		tracks := u.GetRoomTracks()
+		fmt.Println("attach", len(tracks), "tracks to new user")
+		for _, track := range tracks {
+			if _, err := u.AddTrack(track); err != nil {
+				log.Println("ERROR subscribing to published track:", err)
+			}
 		}
 	}
 
-	// Set the remote SessionDescription
 	if err := u.pc.SetRemoteDescription(offer); err != nil {
 		return err
 	}
-	err := u.SendAnswer()
-	if err != nil {
-		return err
+	return u.SendAnswer()
+}
+
+// checkPublishPermissions rejects an offer that tries to publish audio or
+// video this user's join token doesn't grant permission for.
+func (u *User) checkPublishPermissions(offer webrtc.SessionDescription) error {
+	var parsed sdp.SessionDescription
+	if err := parsed.Unmarshal([]byte(offer.SDP)); err != nil {
+		return fmt.Errorf("invalid offer: %w", err)
 	}
 
+	for _, m := range parsed.MediaDescriptions {
+		if !mediaDescriptionSends(m) {
+			continue
+		}
+		switch m.MediaName.Media {
+		case "audio":
+			if !u.permissions.PublishAudio {
+				return errors.New("not permitted to publish audio")
+			}
+		case "video":
+			if !u.permissions.PublishVideo {
+				return errors.New("not permitted to publish video")
+			}
+		}
+	}
 	return nil
 }
 
+// mediaDescriptionSends reports whether m's negotiated direction includes
+// sending media to us. Per RFC 3264, a media section with no explicit
+// direction attribute defaults to sendrecv, so we default to true unless
+// recvonly or inactive is explicitly present — not the other way around,
+// which would let a publisher bypass permissions just by omitting the
+// direction line.
+func mediaDescriptionSends(m *sdp.MediaDescription) bool {
+	if _, ok := m.Attribute(sdp.AttrKeyRecvOnly); ok {
+		return false
+	}
+	if _, ok := m.Attribute(sdp.AttrKeyInactive); ok {
+		return false
+	}
+	return true
+}
+
 // Offer return a offer
 func (u *User) Offer() (webrtc.SessionDescription, error) {
 	offer, err := u.pc.CreateOffer(nil)
@@ -284,11 +583,10 @@ func (u *User) Offer() (webrtc.SessionDescription, error) {
 // SendOffer creates webrtc offer
 func (u *User) SendOffer() error {
 	offer, err := u.Offer()
-	err = u.SendJSON(Event{Type: "offer", Offer: &offer})
 	if err != nil {
-		panic(err)
+		return err
 	}
-	return nil
+	return u.SendJSON(Event{Type: "offer", Offer: &offer})
 }
 
 // SendCandidate sends ice candidate to peer
@@ -327,114 +625,79 @@ func (u *User) SendAnswer() error {
 	return nil
 }
 
-// receiveInTrackRTP receive all incoming tracks' rtp and sent to one channel
-func (u *User) receiveInTrackRTP(remoteTrack *webrtc.Track) {
-	for {
-		// if u.stop {
-		// 	return
-		// }
-		rtp, err := remoteTrack.ReadRTP()
-		if err != nil {
-			if err == io.EOF {
-				return
-			}
-			log.Fatalf("rtp err => %v", err)
-		}
-		u.rtpCh <- rtp
-	}
+// GetOutTracks returns the tracks this user currently subscribes to, keyed
+// by local SSRC.
+func (u *User) GetOutTracks() map[uint32]*downTrack {
+	u.outTracksLock.RLock()
+	defer u.outTracksLock.RUnlock()
+	return u.outTracks
 }
 
-// ReadRTP read rtp packet
-func (u *User) ReadRTP() (*rtp.Packet, error) {
-	rtp, ok := <-u.rtpCh
-	if !ok {
-		return nil, errChanClosed
+// AddTrack subscribes u to up, adding a local track to u's peer connection
+// (triggering renegotiation) and wiring up NACK/PLI feedback from u back to
+// up's publisher.
+func (u *User) AddTrack(up *upTrack) (*downTrack, error) {
+	track, err := u.pc.NewTrack(up.track.PayloadType(), rand.Uint32(), up.track.ID(), up.track.Label())
+	if err != nil {
+		return nil, err
 	}
-	return rtp, nil
-}
-
-// WriteRTP send rtp packet to user outgoing tracks
-func (u *User) WriteRTP(pkt *rtp.Packet) error {
-	if pkt == nil {
-		return errInvalidPacket
+	sender, err := u.pc.AddTrack(track)
+	if err != nil {
+		return nil, err
 	}
-	u.outTracksLock.RLock()
-	track := u.outTracks[pkt.SSRC]
-	u.outTracksLock.RUnlock()
 
-	if track == nil {
-		log.Printf("WebRTCTransport.WriteRTP track==nil pkt.SSRC=%d", pkt.SSRC)
-		return errInvalidTrack
-	}
+	dt := newDownTrack(u, track, up)
+	up.subscribe(dt)
+	up.onSubscriberJoined()
 
-	// log.Debugf("WebRTCTransport.WriteRTP pkt=%v", pkt)
-	err := track.WriteRTP(pkt)
-	if err != nil {
-		// log.Errorf(err.Error())
-		// u.writeErrCnt++
-		return err
+	if up.group != nil {
+		dt.group = up.group
+		go dt.runLayerScheduler()
 	}
-	return nil
+
+	u.outTracksLock.Lock()
+	u.outTracks[track.SSRC()] = dt
+	u.outTracksLock.Unlock()
+
+	go u.readRTCP(sender, dt)
+	return dt, nil
 }
 
-func (u *User) broadcastIncomingRTP() {
+// readRTCP pumps RTCP feedback (NACK, PLI/FIR) from sender to dt until the
+// sender's connection closes.
+func (u *User) readRTCP(sender *webrtc.RTPSender, dt *downTrack) {
 	for {
-		rtp, err := u.ReadRTP()
+		pkts, err := sender.ReadRTCP()
 		if err != nil {
-			panic(err)
-		}
-		for _, user := range u.room.GetOtherUsers(u) {
-			err := user.WriteRTP(rtp)
-			if err != nil {
-				// panic(err)
-				fmt.Println(err)
-			}
+			return
 		}
+		dt.handleRTCP(pkts)
 	}
 }
 
-// GetOutTracks return incoming tracks
-func (u *User) GetOutTracks() map[uint32]*webrtc.Track {
-	u.outTracksLock.RLock()
-	defer u.outTracksLock.RUnlock()
-	return u.outTracks
-}
-
-// AddTrack adds track dynamically with renegotiation
-func (u *User) AddTrack(ssrc uint32) error {
-	track, err := u.pc.NewTrack(webrtc.DefaultPayloadTypeOpus, ssrc, "pion", "pion")
-	if err != nil {
-		return err
+// unsubscribeAll stops every downTrack u subscribes to (and their layer
+// schedulers, if any), so they stop being forwarded packets once u
+// disconnects.
+func (u *User) unsubscribeAll() {
+	for _, dt := range u.GetOutTracks() {
+		dt.close()
 	}
-	if _, err := u.pc.AddTrack(track); err != nil {
-		log.Println("ERROR Add remote track as peerConnection local track", err)
-		return err
-	}
-
-	u.outTracksLock.Lock()
-	u.outTracks[track.SSRC()] = track
-	u.outTracksLock.Unlock()
-	return nil
 }
 
-// AddTrack add track to pc
-// func (w *WebRTCTransport) AddTrack(ssrc uint32, pt uint8, streamID string, trackID string) (*webrtc.Track, error) {
-// 	if w.pc == nil {
-// 		return nil, errInvalidPC
-// 	}
-// 	track, err := w.pc.NewTrack(pt, ssrc, trackID, streamID)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	if _, err = w.pc.AddTrack(track); err != nil {
-// 		return nil, err
-// 	}
-
-// 	w.outTrackLock.Lock()
-// 	w.outTracks[ssrc] = track
-// 	w.outTrackLock.Unlock()
-// 	return track, nil
-// }
+// leaveRoom removes u from its room for good: it unsubscribes u from every
+// track it was forwarding, removes it from the room's member list, and
+// broadcasts the leave to whoever remains. It's triggered by either an
+// explicit "leave" event or the websocket closing (readPump's deferred
+// cleanup), whichever happens first — leaveOnce makes sure only one of
+// those actually runs it, so a client that sends "leave" and then closes
+// its socket doesn't get announced twice.
+func (u *User) leaveRoom() {
+	u.leaveOnce.Do(func() {
+		u.unsubscribeAll()
+		u.room.Leave(u)
+		u.room.Broadcast(Event{Type: "presence", Desc: "leave", Nick: u.Nick()})
+	})
+}
 
 var count = 0
 
@@ -452,75 +715,35 @@ func (u *User) Watch() {
 
 // serveWs handles websocket requests from the peer.
 func serveWs(rooms *Rooms, w http.ResponseWriter, r *http.Request) {
+	roomID := strings.ReplaceAll(r.URL.Path, "/", "")
+
+	claims, err := verifyJoinToken(r.URL.Query().Get("token"), roomID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("join denied: %v", err), http.StatusUnauthorized)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	mediaEngine := webrtc.MediaEngine{}
-	mediaEngine.RegisterCodec(webrtc.NewRTPOpusCodec(webrtc.DefaultPayloadTypeOpus, 48000))
-
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
-	peerConnection, err := api.NewPeerConnection(peerConnectionConfig)
-
-	roomID := strings.ReplaceAll(r.URL.Path, "/", "")
 	room := rooms.GetOrCreate(roomID)
 
 	log.Println("ws connection to room:", roomID, len(room.GetUsers()), "users")
 
 	count++
 	user := &User{
-		ID:        count,
-		room:      room,
-		conn:      conn,
-		send:      make(chan []byte, 256),
-		pc:        peerConnection,
-		outTracks: make(map[uint32]*webrtc.Track),
-		rtpCh:     make(chan *rtp.Packet, 100),
-	}
-
-	user.pc.OnICECandidate(func(iceCandidate *webrtc.ICECandidate) {
-		if iceCandidate != nil {
-			err := user.SendCandidate(iceCandidate)
-			if err != nil {
-				log.Println("fail send candidate", err)
-			}
-		}
-	})
-
-	user.pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		log.Printf("Connection State has changed %s \n", connectionState.String())
-		if connectionState == webrtc.ICEConnectionStateConnected {
-			log.Println("user joined")
-			// room.MembersCount++
-			log.Println("now members count is", len(user.room.GetUsers()))
-		} else if connectionState == webrtc.ICEConnectionStateDisconnected ||
-			connectionState == webrtc.ICEConnectionStateFailed ||
-			connectionState == webrtc.ICEConnectionStateClosed {
-			log.Println("user leaved")
-			// delete(r.Users, user.ID)
-			log.Println("now members count is", len(user.room.GetUsers()))
-		}
-	})
-
-	user.pc.OnTrack(func(remoteTrack *webrtc.Track, receiver *webrtc.RTPReceiver) {
-		log.Println("user id: ", user.ID, "peerConnection.OnTrack")
-		user.inTrack = remoteTrack
-
-		for _, roomUser := range user.room.GetOtherUsers(user) {
-			if err := roomUser.AddTrack(remoteTrack.SSRC()); err != nil {
-				panic(err)
-			}
-			err := roomUser.SendOffer()
-			if err != nil {
-				panic(err)
-			}
-		}
-		log.Printf("Track has started, of type %d: %s, ssrc: %d \n", remoteTrack.PayloadType(), remoteTrack.Codec().Name, remoteTrack.SSRC())
-		go user.receiveInTrackRTP(remoteTrack)
-		go user.broadcastIncomingRTP()
-	})
+		ID:          count,
+		room:        room,
+		conn:        conn,
+		send:        make(chan []byte, 256),
+		outTracks:   make(map[uint32]*downTrack),
+		permissions: claims.Permissions,
+	}
+	// user.pc is built lazily in HandleOffer, once we know what codecs the
+	// peer's offer actually negotiates.
 
 	user.room.Join(user)
 